@@ -2,14 +2,17 @@ package bridge
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
 	"io"
 	"log"
 	"runtime"
+	"sync"
 	"time"
 
 	"github.com/snksoft/crc"
 	"go.bug.st/serial.v1"
+	"golang.org/x/time/rate"
 )
 
 type Message struct {
@@ -28,6 +31,38 @@ type Bridge struct {
 	peers      []peer
 	Inbox      <-chan Message
 	Outbox     chan<- Message
+
+	sessionsMu   sync.Mutex
+	sessions     map[[6]byte]*session
+	handshakes   map[[6]byte]*handshakeState
+	handshakeOut chan handshakeFrame
+
+	replayMu       sync.Mutex
+	replayStates   map[[6]byte]*replayState
+	sendCountersMu sync.Mutex
+	sendCounters   map[[6]byte]uint64
+
+	protocolsMu sync.Mutex
+	protocols   []Protocol
+	peersObjMu  sync.Mutex
+	peerObjects map[[6]byte]*Peer
+	codedOutbox chan Message
+
+	msgChansMu sync.Mutex
+	msgChans   map[uint8]chan Msg
+
+	rateLimitMu   sync.Mutex
+	perPeerLimit  rate.Limit
+	perPeerBurst  int
+	peerLimiters  map[[6]byte]*peerLimiter
+	globalLimiter *rate.Limiter
+
+	store         MessageStore
+	retransmitCfg RetransmitConfig
+	persistOutbox chan persistentSend
+	connected     chan struct{}
+	inFlightMu    sync.Mutex
+	inFlight      map[[6]byte]map[uint32]*inFlightEntry
 }
 
 func (b *Bridge) Connect(portName string) error {
@@ -64,7 +99,7 @@ func (b *Bridge) AddPeer(mac [6]byte, wifiChannel uint8) error {
 	}
 	newPeer := peer{wifiChannel: wifiChannel}
 	copy(newPeer.mac[:], mac[:])
-	b.peers = append(b.peers)
+	b.peers = append(b.peers, newPeer)
 	return nil
 }
 
@@ -85,7 +120,7 @@ func (b *Bridge) RemovePeer(mac [6]byte) {
 	}
 }
 
-func (b Bridge) WaitForConnected(maxWait time.Duration) {
+func (b *Bridge) WaitForConnected(maxWait time.Duration) {
 	end := time.Now().Add(maxWait)
 	for end.Before(time.Now()) {
 		if b.active {
@@ -106,8 +141,12 @@ func (b *Bridge) setupBridge() error {
 	outbox := make(chan Message, 64)
 	reset := make(chan bool)
 	sendPeers := make(chan bool)
+	b.handshakeOut = make(chan handshakeFrame, 8)
+	b.persistOutbox = make(chan persistentSend, 64)
+	b.codedOutbox = make(chan Message, 64)
+	b.connected = make(chan struct{}, 1)
 	go readBytes(b.connection, bytesRead)
-	go reassembleMessages(bytesRead, &b.active, reset, sendPeers, inbox)
+	go reassembleMessages(b, bytesRead, &b.active, reset, sendPeers, inbox)
 	go writeBytes(b, outbox, reset, sendPeers)
 
 	reset <- true // start of with a reset
@@ -145,7 +184,7 @@ func getBytes(input <-chan byte, len int) ([]byte, bool) {
 	return result, true
 }
 
-func reassembleMessages(input <-chan byte, active *bool, reset chan<- bool, sendPeers chan<- bool, output chan<- Message) {
+func reassembleMessages(b *Bridge, input <-chan byte, active *bool, reset chan<- bool, sendPeers chan<- bool, output chan<- Message) {
 	activationHeader := [...]byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77}
 	crcFunction := crc.NewHashWithTable(crc.NewTable(crc.XMODEM))
 
@@ -158,11 +197,11 @@ func reassembleMessages(input <-chan byte, active *bool, reset chan<- bool, send
 			var detected = 0
 			for detected < len(activationHeader) {
 				select {
-				case b, running := <-input:
+				case next, running := <-input:
 					if !running {
 						return
 					}
-					if b == activationHeader[detected] {
+					if next == activationHeader[detected] {
 						detected++
 					} else {
 						detected = 0
@@ -174,6 +213,10 @@ func reassembleMessages(input <-chan byte, active *bool, reset chan<- bool, send
 			}
 			log.Println("Bridge connected")
 			*active = true
+			select {
+			case b.connected <- struct{}{}:
+			default:
+			}
 		}
 		header, running := getBytes(input, 2)
 		if !running {
@@ -183,6 +226,7 @@ func reassembleMessages(input <-chan byte, active *bool, reset chan<- bool, send
 		case header[0] == 0x55 && header[1] == 0x44:
 			// new message, read next bytes for the structure
 			mac, running := getBytes(input, 6)
+			counterBytes, running := getBytes(input, 8)
 			crc, running := getBytes(input, 2)
 			size, running := <-input
 			if !running {
@@ -192,22 +236,102 @@ func reassembleMessages(input <-chan byte, active *bool, reset chan<- bool, send
 			if !running {
 				return
 			}
-			dataCRC := crcFunction.CalculateCRC(data)
+			dataCRC := crcFunction.CalculateCRC(append(append([]byte{}, counterBytes...), data...))
 			if (uint16(crc[0]) | (uint16(crc[1]) << 8)) != uint16(dataCRC) {
 				log.Println("Resetting stream due to crc failure")
 				*active = false
 				continue
 			}
-			msg := Message{
-				Data: data,
+			var mac6 [6]byte
+			copy(mac6[:], mac)
+			if !b.allowInbound(mac6) {
+				continue
+			}
+			counter := binary.BigEndian.Uint64(counterBytes)
+			if !b.checkReplay(mac6, counter) {
+				log.Printf("Dropping replayed or out-of-window frame from %x\n", mac6)
+				continue
+			}
+
+			b.sessionsMu.Lock()
+			sess, encrypted := b.sessions[mac6]
+			b.sessionsMu.Unlock()
+			if encrypted {
+				if !sess.established {
+					log.Println("Dropping frame for peer with an in-flight handshake")
+					continue
+				}
+				plain, err := b.decryptReceived(sess, data)
+				if err != nil {
+					log.Println("Dropping frame that failed authentication")
+					continue
+				}
+				data = plain
 			}
-			copy(msg.Mac[:], mac)
-			//log.Printf("Received new message: %v", msg)
-			output <- msg
+
+			if len(data) == 0 {
+				log.Println("Dropping empty frame")
+				continue
+			}
+			if data[0] == 0 {
+				// raw Inbox/Outbox compatibility shim: code 0 is never
+				// claimed by a Protocol or SendMsg, see Register/SendMsg
+				output <- Message{Mac: mac6, Data: data[1:]}
+				continue
+			}
+			if b.dispatchToProtocol(mac6, data) {
+				continue
+			}
+			b.dispatchToMsgChan(mac6, data)
 		case header[0] == 0x44 && header[1] == 0x33:
 			// request to get all peers (restart of the node for example)
 			log.Println("Request to get all peers received")
 			sendPeers <- true
+		case header[0] == 0x55 && header[1] == 0x33:
+			// ACK for a persisted message: mac[6] || seq[4]
+			mac, running := getBytes(input, 6)
+			seq, running := getBytes(input, 4)
+			if !running {
+				return
+			}
+			ack := parseAckFrame(mac, seq)
+			b.ackPersistent(ack.mac, ack.seq)
+		case header[0] == 0x55 && header[1] == 0x66:
+			// Noise_IK handshake initiation from a peer we've already
+			// registered via AddEncryptedPeer
+			mac, running := getBytes(input, 6)
+			payload, running := getBytes(input, msg1PayloadLen)
+			if !running {
+				return
+			}
+			var mac6 [6]byte
+			copy(mac6[:], mac)
+			ephPub, encStatic, sealedEmpty, ok := splitInitiationPayload(payload)
+			if !ok {
+				continue
+			}
+			response, err := b.handleIncomingHandshake(mac6, ephPub, encStatic, sealedEmpty)
+			if err != nil {
+				log.Printf("Handshake with %x failed: %v\n", mac6, err)
+				continue
+			}
+			b.handshakeOut <- handshakeFrame{mac: mac6, initiator: false, payload: response}
+		case header[0] == 0x55 && header[1] == 0x67:
+			// Noise_IK handshake response to a handshake we initiated
+			mac, running := getBytes(input, 6)
+			payload, running := getBytes(input, msg2PayloadLen)
+			if !running {
+				return
+			}
+			var mac6 [6]byte
+			copy(mac6[:], mac)
+			ephPub, sealed, ok := splitHandshakePayload(payload)
+			if !ok {
+				continue
+			}
+			if err := b.completeHandshakeInitiator(mac6, ephPub, sealed); err != nil {
+				log.Printf("Handshake with %x failed: %v\n", mac6, err)
+			}
 		default:
 			log.Printf("Resetting stream due to unexpected message header %v\n", header)
 			*active = false
@@ -230,10 +354,47 @@ func assureWritten(target io.ReadWriteCloser, data []byte) {
 
 func writeBytes(b *Bridge, box <-chan Message, reset <-chan bool, sendPeers <-chan bool) {
 	sendMessage := []byte{0x22, 0x11}
+	sendPersistentMessage := []byte{0x22, 0x12}
 	resetMessage := []byte{0x42, 0x42, 0x42, 0x42}
 	addPeer := []byte{0x33, 0x22}
 	crcFunction := crc.NewHashWithTable(crc.NewTable(crc.XMODEM))
 
+	// sendApplicationFrame encrypts (if a session is established for mac)
+	// and writes a single 0x22,0x11 data frame. Shared by the raw Outbox
+	// path and the codedOutbox path used by Protocol/SendMsg traffic, so
+	// both get the same session encryption and replay counter handling.
+	sendApplicationFrame := func(mac [6]byte, data []byte) {
+		b.sessionsMu.Lock()
+		sess, encrypted := b.sessions[mac]
+		b.sessionsMu.Unlock()
+		if encrypted {
+			if !sess.established {
+				log.Println("Dropping outgoing message, handshake not yet complete")
+				return
+			}
+			if len(data) > 250-noiseOverhead {
+				log.Fatal("Should not send more than 250 bytes, esp-now can not handle that")
+			}
+			framed, err := b.encryptForSend(sess, data)
+			if err != nil {
+				log.Printf("Dropping outgoing message: %v\n", err)
+				return
+			}
+			data = framed
+		} else if len(data) > 250 {
+			log.Fatal("Should not send more than 250 bytes, esp-now can not handle that")
+		}
+		counterBytes := make([]byte, 8)
+		binary.BigEndian.PutUint64(counterBytes, b.nextSendCounter(mac))
+		assureWritten(b.connection, sendMessage)
+		assureWritten(b.connection, mac[:])
+		assureWritten(b.connection, counterBytes)
+		crc := crcFunction.CalculateCRC(append(append([]byte{}, counterBytes...), data...))
+		assureWritten(b.connection, []byte{uint8(crc & 0xFF), uint8((crc >> 8) & 0xFF)})
+		assureWritten(b.connection, []byte{uint8(len(data))})
+		assureWritten(b.connection, data)
+	}
+
 	for {
 		runtime.Gosched()
 		if !b.active {
@@ -249,15 +410,55 @@ func writeBytes(b *Bridge, box <-chan Message, reset <-chan bool, sendPeers <-ch
 		}
 		select {
 		case msg := <-box:
-			if len(msg.Data) > 250 {
+			// raw Outbox traffic is tagged with a literal code-0 prefix so
+			// it can never collide with a Protocol's or SendMsg's code byte
+			data := append([]byte{0x00}, msg.Data...)
+			sendApplicationFrame(msg.Mac, data)
+
+		case cm := <-b.codedOutbox:
+			sendApplicationFrame(cm.Mac, cm.Data)
+
+		case ps := <-b.persistOutbox:
+			data := append([]byte{0x00}, ps.Data...)
+			b.sessionsMu.Lock()
+			sess, encrypted := b.sessions[ps.Mac]
+			b.sessionsMu.Unlock()
+			if encrypted {
+				if !sess.established {
+					log.Println("Holding persistent message, handshake not yet complete")
+					continue
+				}
+				framed, err := b.encryptForSend(sess, data)
+				if err != nil {
+					log.Printf("Holding persistent message: %v\n", err)
+					continue
+				}
+				data = framed
+			}
+			if len(data) > 250 {
 				log.Fatal("Should not send more than 250 bytes, esp-now can not handle that")
 			}
-			assureWritten(b.connection, sendMessage)
-			assureWritten(b.connection, msg.Mac[:])
-			crc := crcFunction.CalculateCRC(msg.Data)
+			counterBytes := make([]byte, 8)
+			binary.BigEndian.PutUint64(counterBytes, b.nextSendCounter(ps.Mac))
+			assureWritten(b.connection, sendPersistentMessage)
+			assureWritten(b.connection, ps.Mac[:])
+			seqBytes := make([]byte, 4)
+			binary.BigEndian.PutUint32(seqBytes, ps.seq)
+			assureWritten(b.connection, seqBytes)
+			assureWritten(b.connection, counterBytes)
+			crc := crcFunction.CalculateCRC(append(append([]byte{}, counterBytes...), data...))
 			assureWritten(b.connection, []byte{uint8(crc & 0xFF), uint8((crc >> 8) & 0xFF)})
-			assureWritten(b.connection, []byte{uint8(len(msg.Data))})
-			assureWritten(b.connection, msg.Data)
+			assureWritten(b.connection, []byte{uint8(len(data))})
+			assureWritten(b.connection, data)
+
+		case hf := <-b.handshakeOut:
+			header := []byte{0x55, 0x67}
+			if hf.initiator {
+				header = []byte{0x55, 0x66}
+			}
+			assureWritten(b.connection, header)
+			assureWritten(b.connection, hf.mac[:])
+			assureWritten(b.connection, hf.payload)
 
 		case <-reset:
 			assureWritten(b.connection, resetMessage)
@@ -0,0 +1,120 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io/ioutil"
+	"log"
+)
+
+// maxPayload is the largest encoded payload that still fits in a single
+// ESP-NOW frame once the leading code byte is added (see the 250 byte
+// check in writeBytes). Peers with an encrypted session have noiseOverhead
+// fewer bytes available, which SendMsg accounts for.
+const maxPayload = 249
+
+// Msg turns a raw Message into a Msg with code 0, so callers migrating to
+// the typed SendMsg/Protocol APIs don't have to give up Inbox/Outbox.
+func (m Message) Msg() Msg {
+	return Msg{Mac: m.Mac, Code: 0, Size: uint32(len(m.Data)), Payload: bytes.NewReader(m.Data)}
+}
+
+// Decode reads and gob-decodes the Msg's payload into val, which must be a
+// pointer as with encoding/gob.
+func (m Msg) Decode(val interface{}) error {
+	if m.Payload == nil {
+		return errors.New("msg has no payload")
+	}
+	data, err := ioutil.ReadAll(m.Payload)
+	if err != nil {
+		return err
+	}
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(val)
+}
+
+func encodeMsgPayload(val interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(val); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// SendMsg gob-encodes val and sends it to mac tagged with code, so callers
+// no longer have to hand-roll their own length prefixes and endianness for
+// typed application records. It goes through the same wire pipeline as
+// Outbox, so encryption and replay counters still apply; like Outbox, it
+// is not persisted or retried (that is SendPersistent's job).
+// code 0 and any range already claimed by a registered Protocol are
+// rejected, since both own that part of the one-byte wire namespace.
+func (b *Bridge) SendMsg(mac [6]byte, code uint8, val interface{}) error {
+	if code == 0 {
+		return errors.New("code 0 is reserved for the Inbox/Outbox compatibility shim")
+	}
+	if _, owned := b.protocolForCode(code); owned {
+		return errors.New("code is owned by a registered Protocol; use that protocol's MsgReadWriter instead")
+	}
+	payload, err := encodeMsgPayload(val)
+	if err != nil {
+		return err
+	}
+	limit := maxPayload
+	b.sessionsMu.Lock()
+	if _, encrypted := b.sessions[mac]; encrypted {
+		limit -= noiseOverhead
+	}
+	b.sessionsMu.Unlock()
+	if len(payload) > limit {
+		return errors.New("encoded message too large for a single ESP-NOW frame")
+	}
+	data := make([]byte, 1+len(payload))
+	data[0] = code
+	copy(data[1:], payload)
+	b.codedOutbox <- Message{Mac: mac, Data: data}
+	return nil
+}
+
+// Msgs returns the inbound channel for a given code that isn't owned by
+// any registered Protocol, so SendMsg callers have a receive-side
+// counterpart instead of having to read raw Message bytes off Inbox and
+// strip/decode them by hand.
+func (b *Bridge) Msgs(code uint8) (<-chan Msg, error) {
+	if code == 0 {
+		return nil, errors.New("code 0 is delivered on Inbox, not Msgs")
+	}
+	if _, owned := b.protocolForCode(code); owned {
+		return nil, errors.New("code is owned by a registered Protocol; use that protocol's MsgReadWriter instead")
+	}
+	b.msgChansMu.Lock()
+	defer b.msgChansMu.Unlock()
+	if b.msgChans == nil {
+		b.msgChans = make(map[uint8]chan Msg)
+	}
+	ch, ok := b.msgChans[code]
+	if !ok {
+		ch = make(chan Msg, 16)
+		b.msgChans[code] = ch
+	}
+	return ch, nil
+}
+
+// dispatchToMsgChan routes an inbound frame whose code isn't owned by any
+// registered Protocol to the channel a Msgs(code) caller is reading from,
+// if any; otherwise it is dropped.
+func (b *Bridge) dispatchToMsgChan(mac [6]byte, data []byte) {
+	code := data[0]
+	b.msgChansMu.Lock()
+	ch, ok := b.msgChans[code]
+	b.msgChansMu.Unlock()
+	if !ok {
+		log.Printf("Dropping message with no Msgs(%d) consumer from %x\n", code, mac)
+		return
+	}
+	msg := Msg{Mac: mac, Code: uint64(code), Size: uint32(len(data) - 1), Payload: bytes.NewReader(data[1:])}
+	select {
+	case ch <- msg:
+	default:
+		log.Printf("Dropping message for code %d, consumer not keeping up\n", code)
+	}
+}
@@ -0,0 +1,452 @@
+package bridge
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+)
+
+// NoisePrivate is a Curve25519 scalar, our long term static key for a peer.
+type NoisePrivate [32]byte
+
+const (
+	rekeyAfterMessages = 1 << 20
+	rekeyAfterDuration = 10 * time.Minute
+)
+
+// session holds the per-peer Noise_IK transport state. It lives in the
+// bridge process, not on the ESP8266, since the chip has no room to keep
+// more than a handful of link-layer keys around.
+type session struct {
+	mac [6]byte
+
+	ourStatic   NoisePrivate
+	theirStatic [32]byte
+
+	established bool
+	sendKey     [32]byte
+	recvKey     [32]byte
+	sendCounter uint64
+	recvCounter uint64
+
+	createdAt    time.Time
+	messagesSent uint64
+
+	// rekeying is set while a fresh handshake triggered by needsRekey is in
+	// flight, so encryptForSend doesn't start a second one before the first
+	// resolves.
+	rekeying bool
+}
+
+func (s *session) needsRekey() bool {
+	return s.messagesSent >= rekeyAfterMessages || time.Since(s.createdAt) >= rekeyAfterDuration
+}
+
+// handshakeState tracks the Noise symmetric state while a handshake is in
+// flight for a given peer.
+type handshakeState struct {
+	chainKey [32]byte
+	hash     [32]byte
+	ephPriv  [32]byte
+	ephPub   [32]byte
+}
+
+var noiseProtocolName = []byte("Noise_IK_25519_ChaChaPoly_BLAKE2s")
+
+func newHandshakeState() *handshakeState {
+	hs := &handshakeState{}
+	hs.hash = blake2s.Sum256(noiseProtocolName)
+	hs.chainKey = hs.hash
+	return hs
+}
+
+func (hs *handshakeState) mixHash(data []byte) {
+	h, _ := blake2s.New256(nil)
+	h.Write(hs.hash[:])
+	h.Write(data)
+	copy(hs.hash[:], h.Sum(nil))
+}
+
+func (hs *handshakeState) mixKey(input []byte) [32]byte {
+	var output [32]byte
+	mac1, _ := blake2s.New256(hs.chainKey[:])
+	mac1.Write(input)
+	copy(hs.chainKey[:], mac1.Sum(nil))
+	mac2, _ := blake2s.New256(hs.chainKey[:])
+	mac2.Write([]byte{0x01})
+	copy(output[:], mac2.Sum(nil))
+	return output
+}
+
+func dh(priv NoisePrivate, pub [32]byte) ([32]byte, error) {
+	var shared [32]byte
+	out, err := curve25519.X25519(priv[:], pub[:])
+	if err != nil {
+		return shared, err
+	}
+	copy(shared[:], out)
+	return shared, nil
+}
+
+// msg1PayloadLen is the wire size of a Noise_IK message 1: e (32) ||
+// encrypted s (32 + poly1305 tag) || encrypted empty payload (tag only).
+const msg1PayloadLen = 32 + (32 + chacha20poly1305.Overhead) + chacha20poly1305.Overhead
+
+// msg2PayloadLen is the wire size of message 2: e (32) || encrypted empty
+// payload (tag only).
+const msg2PayloadLen = 32 + chacha20poly1305.Overhead
+
+// noiseOverhead is how many bytes encryptForSend adds on top of the
+// plaintext: an 8-byte counter plus the Poly1305 tag.
+const noiseOverhead = 8 + chacha20poly1305.Overhead
+
+// AddEncryptedPeer registers an ESP-NOW peer and kicks off a Noise_IK
+// handshake with it: e, es, s, ss from us, followed by e, ee, se from the
+// peer. Both DH(e, s) and DH(s, s) terms are mixed in on both ends so the
+// responder authenticates the initiator's static key, not just the other
+// way around. Application messages to/from this peer are transparently
+// encrypted and authenticated once the handshake completes.
+func (b *Bridge) AddEncryptedPeer(mac [6]byte, channel uint8, staticPub [32]byte, ourStatic NoisePrivate) error {
+	if err := b.AddPeer(mac, channel); err != nil {
+		return err
+	}
+
+	b.sessionsMu.Lock()
+	if b.sessions == nil {
+		b.sessions = make(map[[6]byte]*session)
+	}
+	sess := &session{mac: mac, ourStatic: ourStatic, theirStatic: staticPub}
+	b.sessions[mac] = sess
+	b.sessionsMu.Unlock()
+
+	return b.initiateHandshake(sess)
+}
+
+// initiateHandshake sends a fresh message 1 (e, es, s, ss) for sess, using
+// the static keys it was registered with. It is used both for the initial
+// handshake from AddEncryptedPeer and to rekey an established session that
+// needsRekey, so it never touches b.peers itself.
+func (b *Bridge) initiateHandshake(sess *session) error {
+	b.sessionsMu.Lock()
+	if b.handshakes == nil {
+		b.handshakes = make(map[[6]byte]*handshakeState)
+	}
+
+	hs := newHandshakeState()
+	var ephPriv [32]byte
+	if _, err := rand.Read(ephPriv[:]); err != nil {
+		b.sessionsMu.Unlock()
+		return err
+	}
+	ephPub, err := curve25519.X25519(ephPriv[:], curve25519.Basepoint)
+	if err != nil {
+		b.sessionsMu.Unlock()
+		return err
+	}
+	copy(hs.ephPriv[:], ephPriv[:])
+	copy(hs.ephPub[:], ephPub)
+	hs.mixHash(hs.ephPub[:])
+	b.handshakes[sess.mac] = hs
+	b.sessionsMu.Unlock()
+
+	// es = DH(e_i, s_r)
+	es, err := dh(NoisePrivate(ephPriv), sess.theirStatic)
+	if err != nil {
+		return err
+	}
+	keyAfterEs := hs.mixKey(es[:])
+
+	ourStaticPub, err := curve25519.X25519(sess.ourStatic[:], curve25519.Basepoint)
+	if err != nil {
+		return err
+	}
+	encStatic, err := noiseSeal(keyAfterEs, 0, ourStaticPub, hs.hash[:])
+	if err != nil {
+		return err
+	}
+	hs.mixHash(encStatic)
+
+	// ss = DH(s_i, s_r)
+	ss, err := dh(sess.ourStatic, sess.theirStatic)
+	if err != nil {
+		return err
+	}
+	keyAfterSs := hs.mixKey(ss[:])
+	sealedEmpty, err := noiseSeal(keyAfterSs, 0, nil, hs.hash[:])
+	if err != nil {
+		return err
+	}
+	hs.mixHash(sealedEmpty)
+
+	frame := append([]byte{}, hs.ephPub[:]...)
+	frame = append(frame, encStatic...)
+	frame = append(frame, sealedEmpty...)
+	b.handshakeOut <- handshakeFrame{mac: sess.mac, initiator: true, payload: frame}
+	return nil
+}
+
+// completeHandshakeInitiator is invoked by reassembleMessages once the
+// peer's handshake response frame (e, ee, se) has arrived.
+func (b *Bridge) completeHandshakeInitiator(mac [6]byte, theirEphPub [32]byte, sealed []byte) error {
+	b.sessionsMu.Lock()
+	hs, ok := b.handshakes[mac]
+	sess, hasSess := b.sessions[mac]
+	b.sessionsMu.Unlock()
+	if !ok || !hasSess {
+		return errors.New("handshake response for unknown peer")
+	}
+
+	hs.mixHash(theirEphPub[:])
+
+	// ee = DH(e_i, e_r)
+	ee, err := dh(NoisePrivate(hs.ephPriv), theirEphPub)
+	if err != nil {
+		return err
+	}
+	hs.mixKey(ee[:])
+
+	// se = DH(s_i, e_r)
+	se, err := dh(sess.ourStatic, theirEphPub)
+	if err != nil {
+		return err
+	}
+	keyAfterSe := hs.mixKey(se[:])
+
+	plain, err := noiseOpen(keyAfterSe, 0, sealed, hs.hash[:])
+	if err != nil {
+		return err
+	}
+	if len(plain) != 0 {
+		return errors.New("handshake response carried unexpected payload")
+	}
+	hs.mixHash(sealed)
+
+	send := hs.mixKey(nil)
+	recv := hs.mixKey(nil)
+
+	b.sessionsMu.Lock()
+	sess.sendKey = send
+	sess.recvKey = recv
+	sess.sendCounter = 0
+	sess.recvCounter = 0
+	sess.messagesSent = 0
+	sess.rekeying = false
+	sess.established = true
+	sess.createdAt = time.Now()
+	delete(b.handshakes, mac)
+	b.sessionsMu.Unlock()
+	return nil
+}
+
+func noiseCipher(key [32]byte) (noiseAEAD, error) {
+	return chacha20poly1305.New(key[:])
+}
+
+type noiseAEAD interface {
+	Seal(dst, nonce, plaintext, additionalData []byte) []byte
+	Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error)
+}
+
+func noiseNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+func noiseSeal(key [32]byte, counter uint64, plaintext, ad []byte) ([]byte, error) {
+	aead, err := noiseCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Seal(nil, noiseNonce(counter), plaintext, ad), nil
+}
+
+func noiseOpen(key [32]byte, counter uint64, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := noiseCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, noiseNonce(counter), ciphertext, ad)
+}
+
+// encryptForSend wraps plaintext as nonce_counter || ciphertext || tag for
+// the given established session. If the session needsRekey, it kicks off a
+// new handshake in the background (reusing the static keys it was
+// registered with) and drops this message; once that handshake completes,
+// sends resume on the new keys.
+func (b *Bridge) encryptForSend(sess *session, plaintext []byte) ([]byte, error) {
+	if sess.needsRekey() {
+		b.sessionsMu.Lock()
+		alreadyRekeying := sess.rekeying
+		sess.rekeying = true
+		b.sessionsMu.Unlock()
+		if !alreadyRekeying {
+			go func() {
+				if err := b.initiateHandshake(sess); err != nil {
+					log.Printf("Dropping rekey attempt for %x: %v\n", sess.mac, err)
+					b.sessionsMu.Lock()
+					sess.rekeying = false
+					b.sessionsMu.Unlock()
+				}
+			}()
+		}
+		return nil, errors.New("session due for rekey, new handshake started automatically")
+	}
+	counter := sess.sendCounter
+	sealed, err := noiseSeal(sess.sendKey, counter, plaintext, nil)
+	if err != nil {
+		return nil, err
+	}
+	sess.sendCounter++
+	sess.messagesSent++
+
+	out := make([]byte, 8+len(sealed))
+	binary.LittleEndian.PutUint64(out[:8], counter)
+	copy(out[8:], sealed)
+	return out, nil
+}
+
+// decryptReceived unwraps a nonce_counter || ciphertext || tag frame,
+// dropping it (via a non-nil error) on any authentication failure.
+func (b *Bridge) decryptReceived(sess *session, framed []byte) ([]byte, error) {
+	if len(framed) < 8+chacha20poly1305.Overhead {
+		return nil, errors.New("encrypted frame too short")
+	}
+	counter := binary.LittleEndian.Uint64(framed[:8])
+	plain, err := noiseOpen(sess.recvKey, counter, framed[8:], nil)
+	if err != nil {
+		return nil, err
+	}
+	sess.recvCounter = counter
+	return plain, nil
+}
+
+// handleIncomingHandshake is called by reassembleMessages when a handshake
+// initiation frame (e, es, s, ss) arrives for a peer that was already
+// registered through AddEncryptedPeer. It decrypts and checks the
+// initiator's static key against the one AddEncryptedPeer was given for
+// this mac, so an attacker who only knows our static public key (but not
+// the initiator's private key) cannot complete a handshake as that peer.
+func (b *Bridge) handleIncomingHandshake(mac [6]byte, theirEphPub [32]byte, encStatic []byte, sealedEmpty []byte) ([]byte, error) {
+	b.sessionsMu.Lock()
+	sess, ok := b.sessions[mac]
+	b.sessionsMu.Unlock()
+	if !ok {
+		return nil, errors.New("handshake initiation for unknown peer, call AddEncryptedPeer first")
+	}
+
+	hs := newHandshakeState()
+	hs.mixHash(theirEphPub[:])
+
+	// es = DH(e_i, s_r)
+	es, err := dh(sess.ourStatic, theirEphPub)
+	if err != nil {
+		return nil, err
+	}
+	keyAfterEs := hs.mixKey(es[:])
+
+	theirStaticPubBytes, err := noiseOpen(keyAfterEs, 0, encStatic, hs.hash[:])
+	if err != nil {
+		return nil, err
+	}
+	var theirStaticPub [32]byte
+	copy(theirStaticPub[:], theirStaticPubBytes)
+	if theirStaticPub != sess.theirStatic {
+		return nil, errors.New("initiator static key does not match the one registered for this peer")
+	}
+	hs.mixHash(encStatic)
+
+	// ss = DH(s_i, s_r)
+	ss, err := dh(sess.ourStatic, theirStaticPub)
+	if err != nil {
+		return nil, err
+	}
+	keyAfterSs := hs.mixKey(ss[:])
+	plain, err := noiseOpen(keyAfterSs, 0, sealedEmpty, hs.hash[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(plain) != 0 {
+		return nil, errors.New("handshake initiation carried unexpected payload")
+	}
+	hs.mixHash(sealedEmpty)
+
+	var ephPriv [32]byte
+	if _, err := rand.Read(ephPriv[:]); err != nil {
+		return nil, err
+	}
+	ephPub, err := curve25519.X25519(ephPriv[:], curve25519.Basepoint)
+	if err != nil {
+		return nil, err
+	}
+	hs.mixHash(ephPub)
+
+	// ee = DH(e_i, e_r)
+	ee, err := dh(NoisePrivate(ephPriv), theirEphPub)
+	if err != nil {
+		return nil, err
+	}
+	hs.mixKey(ee[:])
+
+	// se = DH(s_i, e_r)
+	se, err := dh(NoisePrivate(ephPriv), theirStaticPub)
+	if err != nil {
+		return nil, err
+	}
+	keyAfterSe := hs.mixKey(se[:])
+	responseSealed, err := noiseSeal(keyAfterSe, 0, nil, hs.hash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	recv := hs.mixKey(nil)
+	send := hs.mixKey(nil)
+
+	b.sessionsMu.Lock()
+	sess.sendKey = send
+	sess.recvKey = recv
+	sess.sendCounter = 0
+	sess.recvCounter = 0
+	sess.messagesSent = 0
+	sess.rekeying = false
+	sess.established = true
+	sess.createdAt = time.Now()
+	b.sessionsMu.Unlock()
+
+	response := make([]byte, 32+len(responseSealed))
+	copy(response[:32], ephPub)
+	copy(response[32:], responseSealed)
+	return response, nil
+}
+
+type handshakeFrame struct {
+	mac       [6]byte
+	initiator bool
+	payload   []byte
+}
+
+// splitInitiationPayload splits a message 1 frame into its e, encrypted s,
+// and encrypted empty-payload parts.
+func splitInitiationPayload(payload []byte) (ephPub [32]byte, encStatic []byte, sealedEmpty []byte, ok bool) {
+	if len(payload) != msg1PayloadLen {
+		return ephPub, nil, nil, false
+	}
+	copy(ephPub[:], payload[:32])
+	encStatic = payload[32 : 32+32+chacha20poly1305.Overhead]
+	sealedEmpty = payload[32+32+chacha20poly1305.Overhead:]
+	return ephPub, encStatic, sealedEmpty, true
+}
+
+func splitHandshakePayload(payload []byte) (ephPub [32]byte, sealed []byte, ok bool) {
+	if len(payload) != msg2PayloadLen {
+		return ephPub, nil, false
+	}
+	copy(ephPub[:], payload[:32])
+	return ephPub, payload[32:], true
+}
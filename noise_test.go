@@ -0,0 +1,160 @@
+package bridge
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"golang.org/x/crypto/curve25519"
+)
+
+func TestNoiseSealOpenRoundtrip(t *testing.T) {
+	var key [32]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		t.Fatal(err)
+	}
+	plaintext := []byte("hello esp8266")
+	ad := []byte("associated data")
+
+	sealed, err := noiseSeal(key, 7, plaintext, ad)
+	if err != nil {
+		t.Fatalf("noiseSeal: %v", err)
+	}
+
+	opened, err := noiseOpen(key, 7, sealed, ad)
+	if err != nil {
+		t.Fatalf("noiseOpen: %v", err)
+	}
+	if !bytes.Equal(opened, plaintext) {
+		t.Fatalf("roundtrip mismatch: got %q, want %q", opened, plaintext)
+	}
+
+	if _, err := noiseOpen(key, 8, sealed, ad); err == nil {
+		t.Fatal("noiseOpen should fail with the wrong counter")
+	}
+	if _, err := noiseOpen(key, 7, sealed, []byte("wrong ad")); err == nil {
+		t.Fatal("noiseOpen should fail with mismatched associated data")
+	}
+}
+
+func genStaticKeypair(t *testing.T) (NoisePrivate, [32]byte) {
+	t.Helper()
+	var priv NoisePrivate
+	if _, err := rand.Read(priv[:]); err != nil {
+		t.Fatal(err)
+	}
+	pubBytes, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pub [32]byte
+	copy(pub[:], pubBytes)
+	return priv, pub
+}
+
+// TestHandshakeRoundtrip runs a full Noise_IK exchange between an initiator
+// and a responder Bridge, bypassing the serial/ESP8266 plumbing, and checks
+// both sides end up with matching transport keys that actually encrypt and
+// decrypt each other's traffic.
+func TestHandshakeRoundtrip(t *testing.T) {
+	initiatorStatic, initiatorPub := genStaticKeypair(t)
+	responderStatic, responderPub := genStaticKeypair(t)
+
+	var mac [6]byte
+	copy(mac[:], []byte{1, 2, 3, 4, 5, 6})
+
+	initiatorBridge := &Bridge{handshakeOut: make(chan handshakeFrame, 1)}
+	responderBridge := &Bridge{handshakeOut: make(chan handshakeFrame, 1)}
+
+	responderBridge.sessionsMu.Lock()
+	responderBridge.sessions = map[[6]byte]*session{
+		mac: {mac: mac, ourStatic: responderStatic, theirStatic: initiatorPub},
+	}
+	responderBridge.sessionsMu.Unlock()
+
+	if err := initiatorBridge.AddEncryptedPeer(mac, 1, responderPub, initiatorStatic); err != nil {
+		t.Fatalf("AddEncryptedPeer: %v", err)
+	}
+
+	msg1 := <-initiatorBridge.handshakeOut
+	ephPub, encStatic, sealedEmpty, ok := splitInitiationPayload(msg1.payload)
+	if !ok {
+		t.Fatal("splitInitiationPayload rejected a valid message 1")
+	}
+
+	response, err := responderBridge.handleIncomingHandshake(mac, ephPub, encStatic, sealedEmpty)
+	if err != nil {
+		t.Fatalf("handleIncomingHandshake: %v", err)
+	}
+
+	theirEphPub, sealed, ok := splitHandshakePayload(response)
+	if !ok {
+		t.Fatal("splitHandshakePayload rejected a valid message 2")
+	}
+
+	if err := initiatorBridge.completeHandshakeInitiator(mac, theirEphPub, sealed); err != nil {
+		t.Fatalf("completeHandshakeInitiator: %v", err)
+	}
+
+	initiatorSess := initiatorBridge.sessions[mac]
+	responderSess := responderBridge.sessions[mac]
+	if !initiatorSess.established || !responderSess.established {
+		t.Fatal("both sessions should be established after the handshake")
+	}
+	if initiatorSess.sendKey != responderSess.recvKey {
+		t.Fatal("initiator's send key should match responder's recv key")
+	}
+	if initiatorSess.recvKey != responderSess.sendKey {
+		t.Fatal("initiator's recv key should match responder's send key")
+	}
+
+	plaintext := []byte("application data over the encrypted link")
+	framed, err := initiatorBridge.encryptForSend(initiatorSess, plaintext)
+	if err != nil {
+		t.Fatalf("encryptForSend: %v", err)
+	}
+	decrypted, err := responderBridge.decryptReceived(responderSess, framed)
+	if err != nil {
+		t.Fatalf("decryptReceived: %v", err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Fatalf("decrypted mismatch: got %q, want %q", decrypted, plaintext)
+	}
+}
+
+// TestHandshakeRejectsImpostorStaticKey checks that the responder refuses a
+// handshake whose encrypted initiator static key doesn't match the one it
+// was given when the peer was registered - the core IK authentication
+// property this package relies on.
+func TestHandshakeRejectsImpostorStaticKey(t *testing.T) {
+	initiatorStatic, _ := genStaticKeypair(t)
+	_, impostorPub := genStaticKeypair(t)
+	responderStatic, responderPub := genStaticKeypair(t)
+
+	var mac [6]byte
+	copy(mac[:], []byte{1, 2, 3, 4, 5, 6})
+
+	initiatorBridge := &Bridge{handshakeOut: make(chan handshakeFrame, 1)}
+	responderBridge := &Bridge{handshakeOut: make(chan handshakeFrame, 1)}
+
+	responderBridge.sessionsMu.Lock()
+	responderBridge.sessions = map[[6]byte]*session{
+		// responder expects a different static key than the one the
+		// initiator will actually use below
+		mac: {mac: mac, ourStatic: responderStatic, theirStatic: impostorPub},
+	}
+	responderBridge.sessionsMu.Unlock()
+
+	if err := initiatorBridge.AddEncryptedPeer(mac, 1, responderPub, initiatorStatic); err != nil {
+		t.Fatalf("AddEncryptedPeer: %v", err)
+	}
+	msg1 := <-initiatorBridge.handshakeOut
+	ephPub, encStatic, sealedEmpty, ok := splitInitiationPayload(msg1.payload)
+	if !ok {
+		t.Fatal("splitInitiationPayload rejected a valid message 1")
+	}
+
+	if _, err := responderBridge.handleIncomingHandshake(mac, ephPub, encStatic, sealedEmpty); err == nil {
+		t.Fatal("handshake should be rejected when the initiator's static key doesn't match the registered one")
+	}
+}
@@ -0,0 +1,188 @@
+package bridge
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"sync"
+)
+
+// Msg is a single subprotocol message, analogous to go-ethereum's p2p.Msg:
+// for a Msg read through a Protocol's MsgReadWriter, Code is scoped to the
+// Protocol that owns it, not the wire-level ESP-NOW payload byte. A Msg
+// delivered on a Msgs(code) channel carries the wire-level code byte.
+type Msg struct {
+	Mac     [6]byte
+	Code    uint64
+	Size    uint32
+	Payload io.Reader
+}
+
+// Protocol describes a subprotocol that can be layered on top of a Bridge.
+// Code/Length reserve a range of payload-prefix bytes ([Code, Code+Length))
+// that this protocol owns; Run is started once per Peer that speaks to it.
+type Protocol struct {
+	Name   string
+	Code   uint8
+	Length uint8
+	Run    func(peer *Peer, rw MsgReadWriter) error
+}
+
+// MsgReadWriter lets a Protocol's Run function exchange Msg values with a
+// single remote Peer without knowing about ESP-NOW framing underneath.
+type MsgReadWriter interface {
+	ReadMsg() (Msg, error)
+	WriteMsg(Msg) error
+}
+
+// Peer represents one remote MAC address from the point of view of the
+// registered subprotocols running against it.
+type Peer struct {
+	Mac [6]byte
+
+	bridge  *Bridge
+	mu      sync.Mutex
+	inboxes map[string]chan Msg
+	started map[string]bool
+}
+
+func (p *Peer) inboxFor(name string) chan Msg {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inboxes == nil {
+		p.inboxes = make(map[string]chan Msg)
+	}
+	ch, ok := p.inboxes[name]
+	if !ok {
+		ch = make(chan Msg, 16)
+		p.inboxes[name] = ch
+	}
+	return ch
+}
+
+type protoReadWriter struct {
+	peer  *Peer
+	proto Protocol
+}
+
+func (rw protoReadWriter) ReadMsg() (Msg, error) {
+	msg, ok := <-rw.peer.inboxFor(rw.proto.Name)
+	if !ok {
+		return Msg{}, io.EOF
+	}
+	return msg, nil
+}
+
+func (rw protoReadWriter) WriteMsg(msg Msg) error {
+	if msg.Code >= uint64(rw.proto.Length) {
+		return errors.New("message code out of range for protocol")
+	}
+	var payload []byte
+	if msg.Payload != nil {
+		var err error
+		payload, err = ioutil.ReadAll(msg.Payload)
+		if err != nil {
+			return err
+		}
+	}
+	data := make([]byte, 1+len(payload))
+	data[0] = rw.proto.Code + uint8(msg.Code)
+	copy(data[1:], payload)
+	rw.peer.bridge.codedOutbox <- Message{Mac: rw.peer.Mac, Data: data}
+	return nil
+}
+
+// Register reserves [p.Code, p.Code+p.Length) for p and starts p.Run once
+// per peer that sends traffic in that range. Code 0 is reserved for the
+// Inbox/Outbox compatibility shim and cannot be registered directly.
+func (b *Bridge) Register(p Protocol) error {
+	if p.Length == 0 {
+		return errors.New("protocol must own at least one code")
+	}
+	if p.Code == 0 {
+		return errors.New("code 0 is reserved for the Inbox/Outbox compatibility shim")
+	}
+	b.protocolsMu.Lock()
+	defer b.protocolsMu.Unlock()
+	for _, existing := range b.protocols {
+		if codesOverlap(existing, p) {
+			return errors.New("protocol code range overlaps with " + existing.Name)
+		}
+	}
+	b.protocols = append(b.protocols, p)
+	return nil
+}
+
+func codesOverlap(a, b Protocol) bool {
+	aEnd := int(a.Code) + int(a.Length)
+	bEnd := int(b.Code) + int(b.Length)
+	return int(a.Code) < bEnd && int(b.Code) < aEnd
+}
+
+func (b *Bridge) protocolForCode(code uint8) (Protocol, bool) {
+	b.protocolsMu.Lock()
+	defer b.protocolsMu.Unlock()
+	for _, p := range b.protocols {
+		if int(code) >= int(p.Code) && int(code) < int(p.Code)+int(p.Length) {
+			return p, true
+		}
+	}
+	return Protocol{}, false
+}
+
+func (b *Bridge) peerFor(mac [6]byte) *Peer {
+	b.peersObjMu.Lock()
+	defer b.peersObjMu.Unlock()
+	if b.peerObjects == nil {
+		b.peerObjects = make(map[[6]byte]*Peer)
+	}
+	peer, ok := b.peerObjects[mac]
+	if !ok {
+		peer = &Peer{Mac: mac, bridge: b}
+		b.peerObjects[mac] = peer
+	}
+	return peer
+}
+
+// dispatchToProtocol routes an inbound, already-decrypted/authenticated
+// frame to the registered Protocol matching its first byte. It reports
+// whether a protocol claimed the frame; the caller is expected to have
+// already handled data[0] == 0 (the raw Inbox shim) before calling this,
+// since code 0 can never be registered by a Protocol.
+func (b *Bridge) dispatchToProtocol(mac [6]byte, data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	proto, ok := b.protocolForCode(data[0])
+	if !ok {
+		return false
+	}
+
+	peer := b.peerFor(mac)
+	peer.mu.Lock()
+	if peer.started == nil {
+		peer.started = make(map[string]bool)
+	}
+	firstRun := !peer.started[proto.Name]
+	peer.started[proto.Name] = true
+	peer.mu.Unlock()
+	if firstRun {
+		rw := protoReadWriter{peer: peer, proto: proto}
+		go proto.Run(peer, rw)
+	}
+
+	msg := Msg{
+		Mac:     mac,
+		Code:    uint64(data[0] - proto.Code),
+		Size:    uint32(len(data) - 1),
+		Payload: bytes.NewReader(data[1:]),
+	}
+	select {
+	case peer.inboxFor(proto.Name) <- msg:
+	default:
+		log.Printf("Dropping message for protocol %s, consumer not keeping up\n", proto.Name)
+	}
+	return true
+}
@@ -0,0 +1,115 @@
+package bridge
+
+import (
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// inboxCapacity mirrors the buffer size of the inbox channel created in
+// setupBridge, so the global rate limiter's burst can't let a storm of
+// peers fill it faster than callers can drain it.
+const inboxCapacity = 64
+
+// maxConcurrentPeers mirrors the ESP8266 ESP-NOW peer table limit, which
+// caps how many well-behaved peers can ever be sending at once. The global
+// bucket is sized for that many peers each sustaining their own per-peer
+// rate, not a single peer's rate, so legitimate traffic from many peers
+// doesn't collectively get throttled down to one peer's budget.
+const maxConcurrentPeers = 20
+
+const limiterIdleTimeout = 10 * time.Minute
+
+type peerLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+	dropped  uint64
+}
+
+// SetRateLimit enables per-peer token-bucket throttling of inbound frames:
+// each peer may sustain perPeer messages/sec with bursts up to burst, and a
+// global bucket on top of that caps the combined rate from all peers so a
+// storm can't exhaust the shared inbox buffer.
+func (b *Bridge) SetRateLimit(perPeer rate.Limit, burst int) {
+	b.rateLimitMu.Lock()
+	defer b.rateLimitMu.Unlock()
+	b.perPeerLimit = perPeer
+	b.perPeerBurst = burst
+	if b.peerLimiters == nil {
+		b.peerLimiters = make(map[[6]byte]*peerLimiter)
+		go b.gcIdleLimiters()
+	}
+	globalLimit := rate.Limit(float64(perPeer) * maxConcurrentPeers)
+	if b.globalLimiter == nil {
+		b.globalLimiter = rate.NewLimiter(globalLimit, inboxCapacity)
+	} else {
+		b.globalLimiter.SetLimit(globalLimit)
+		b.globalLimiter.SetBurst(inboxCapacity)
+	}
+	for _, pl := range b.peerLimiters {
+		pl.limiter.SetLimit(perPeer)
+		pl.limiter.SetBurst(burst)
+	}
+}
+
+// Dropped reports how many inbound frames from mac have been throttled by
+// the rate limiter since it was enabled. The count starts again from zero
+// once the peer's bucket is garbage-collected after limiterIdleTimeout of
+// inactivity.
+func (b *Bridge) Dropped(mac [6]byte) uint64 {
+	b.rateLimitMu.Lock()
+	defer b.rateLimitMu.Unlock()
+	pl, ok := b.peerLimiters[mac]
+	if !ok {
+		return 0
+	}
+	return pl.dropped
+}
+
+// allowInbound applies the per-peer and global token buckets to an inbound
+// frame. It never blocks, so a throttled peer can't backpressure the
+// shared bytesRead reader goroutine that feeds every peer.
+func (b *Bridge) allowInbound(mac [6]byte) bool {
+	b.rateLimitMu.Lock()
+	if b.peerLimiters == nil {
+		b.rateLimitMu.Unlock()
+		return true
+	}
+	pl, ok := b.peerLimiters[mac]
+	if !ok {
+		pl = &peerLimiter{limiter: rate.NewLimiter(b.perPeerLimit, b.perPeerBurst)}
+		b.peerLimiters[mac] = pl
+	}
+	pl.lastSeen = time.Now()
+	global := b.globalLimiter
+	b.rateLimitMu.Unlock()
+
+	if global != nil && !global.Allow() {
+		b.rateLimitMu.Lock()
+		pl.dropped++
+		b.rateLimitMu.Unlock()
+		return false
+	}
+	if !pl.limiter.Allow() {
+		b.rateLimitMu.Lock()
+		pl.dropped++
+		b.rateLimitMu.Unlock()
+		return false
+	}
+	return true
+}
+
+func (b *Bridge) gcIdleLimiters() {
+	ticker := time.NewTicker(1 * time.Minute)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.rateLimitMu.Lock()
+		now := time.Now()
+		for mac, pl := range b.peerLimiters {
+			if now.Sub(pl.lastSeen) > limiterIdleTimeout {
+				delete(b.peerLimiters, mac)
+			}
+		}
+		b.rateLimitMu.Unlock()
+	}
+}
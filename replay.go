@@ -0,0 +1,125 @@
+package bridge
+
+// replayWindowSize is the width of the sliding bitmap: a counter must
+// either be new, or fall within the last 256 values and not have been
+// seen before.
+const replayWindowSize = 256
+
+// replayState is the per-peer sliding-window replay filter.
+type replayState struct {
+	highestCounter uint64
+	bitmap         [4]uint64
+
+	accepted  uint64
+	rejected  uint64
+	duplicate uint64
+}
+
+// ReplayCounters reports how many inbound frames from mac were accepted,
+// rejected as out-of-window, or rejected as duplicates.
+type ReplayCounters struct {
+	Accepted  uint64
+	Rejected  uint64
+	Duplicate uint64
+}
+
+// ReplayStats returns the replay-protection counters for a peer. The zero
+// value is returned if no frame has been seen from mac yet.
+func (b *Bridge) ReplayStats(mac [6]byte) ReplayCounters {
+	b.replayMu.Lock()
+	defer b.replayMu.Unlock()
+	state, ok := b.replayStates[mac]
+	if !ok {
+		return ReplayCounters{}
+	}
+	return ReplayCounters{
+		Accepted:  state.accepted,
+		Rejected:  state.rejected,
+		Duplicate: state.duplicate,
+	}
+}
+
+func bitmapBit(bitmap *[4]uint64, index uint64) bool {
+	word, bit := index/64, index%64
+	return bitmap[word]&(1<<bit) != 0
+}
+
+func bitmapSetBit(bitmap *[4]uint64, index uint64) {
+	word, bit := index/64, index%64
+	bitmap[word] |= 1 << bit
+}
+
+func bitmapShiftLeft(bitmap *[4]uint64, shift uint64) {
+	if shift >= replayWindowSize {
+		*bitmap = [4]uint64{}
+		return
+	}
+	words, bits := shift/64, shift%64
+	for i := len(bitmap) - 1; i >= 0; i-- {
+		var carry uint64
+		src := i - int(words)
+		if src >= 0 {
+			bitmap[i] = bitmap[src] << bits
+			if bits > 0 && src-1 >= 0 {
+				carry = bitmap[src-1] >> (64 - bits)
+			}
+			bitmap[i] |= carry
+		} else {
+			bitmap[i] = 0
+		}
+	}
+}
+
+// allow applies the sliding window check and updates state in place. It
+// reports whether counter should be accepted.
+func (state *replayState) allow(counter uint64) bool {
+	if counter > state.highestCounter {
+		shift := counter - state.highestCounter
+		bitmapShiftLeft(&state.bitmap, shift)
+		bitmapSetBit(&state.bitmap, 0)
+		state.highestCounter = counter
+		state.accepted++
+		return true
+	}
+
+	diff := state.highestCounter - counter
+	if diff >= replayWindowSize {
+		state.rejected++
+		return false
+	}
+	if bitmapBit(&state.bitmap, diff) {
+		state.duplicate++
+		return false
+	}
+	bitmapSetBit(&state.bitmap, diff)
+	state.accepted++
+	return true
+}
+
+// checkReplay runs the per-MAC replay filter for an inbound frame,
+// creating the peer's state on first contact.
+func (b *Bridge) checkReplay(mac [6]byte, counter uint64) bool {
+	b.replayMu.Lock()
+	defer b.replayMu.Unlock()
+	if b.replayStates == nil {
+		b.replayStates = make(map[[6]byte]*replayState)
+	}
+	state, ok := b.replayStates[mac]
+	if !ok {
+		state = &replayState{}
+		b.replayStates[mac] = state
+	}
+	return state.allow(counter)
+}
+
+// nextSendCounter hands out the next outgoing counter for mac, starting
+// at 1 so a freshly connected peer can treat 0 as "nothing seen yet".
+func (b *Bridge) nextSendCounter(mac [6]byte) uint64 {
+	b.sendCountersMu.Lock()
+	defer b.sendCountersMu.Unlock()
+	if b.sendCounters == nil {
+		b.sendCounters = make(map[[6]byte]uint64)
+	}
+	b.sendCounters[mac]++
+	return b.sendCounters[mac]
+}
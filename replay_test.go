@@ -0,0 +1,74 @@
+package bridge
+
+import "testing"
+
+func TestReplayStateAllow(t *testing.T) {
+	cases := []struct {
+		name     string
+		counters []uint64
+		want     []bool
+	}{
+		{
+			name:     "monotonic increasing always accepted",
+			counters: []uint64{1, 2, 3, 100},
+			want:     []bool{true, true, true, true},
+		},
+		{
+			name:     "duplicate is rejected",
+			counters: []uint64{5, 5},
+			want:     []bool{true, false},
+		},
+		{
+			name:     "in-window out-of-order is accepted once",
+			counters: []uint64{10, 5, 5},
+			want:     []bool{true, true, false},
+		},
+		{
+			name:     "older than the window is rejected",
+			counters: []uint64{replayWindowSize + 10, 5},
+			want:     []bool{true, false},
+		},
+		{
+			name:     "zero counter accepted first, rejected as duplicate after",
+			counters: []uint64{0, 0},
+			want:     []bool{true, false},
+		},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			state := &replayState{}
+			for i, counter := range tc.counters {
+				got := state.allow(counter)
+				if got != tc.want[i] {
+					t.Fatalf("allow(%d) #%d = %v, want %v", counter, i, got, tc.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBitmapShiftLeft(t *testing.T) {
+	var bitmap [4]uint64
+	bitmapSetBit(&bitmap, 0)
+
+	bitmapShiftLeft(&bitmap, 1)
+	if bitmapBit(&bitmap, 0) {
+		t.Fatal("bit 0 should have shifted away from index 0")
+	}
+	if !bitmapBit(&bitmap, 1) {
+		t.Fatal("bit originally at 0 should now be at index 1")
+	}
+
+	bitmapShiftLeft(&bitmap, 63)
+	if !bitmapBit(&bitmap, 64) {
+		t.Fatal("shift should carry a bit across a word boundary")
+	}
+
+	var full [4]uint64
+	bitmapSetBit(&full, 200)
+	bitmapShiftLeft(&full, replayWindowSize)
+	if full != ([4]uint64{}) {
+		t.Fatal("shifting by the full window size should clear the bitmap")
+	}
+}
@@ -0,0 +1,187 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// RetransmitConfig tunes how aggressively un-ACKed persisted messages are
+// replayed.
+type RetransmitConfig struct {
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// MaxInFlight caps how many un-ACKed messages a single peer may have
+	// outstanding at once, so one dead peer cannot starve the others.
+	MaxInFlight int
+}
+
+// DefaultRetransmitConfig is a conservative exponential backoff tuned for
+// the 460800 baud serial link to the ESP8266.
+func DefaultRetransmitConfig() RetransmitConfig {
+	return RetransmitConfig{
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     30 * time.Second,
+		MaxInFlight:    16,
+	}
+}
+
+type persistentSend struct {
+	seq uint32
+	Message
+}
+
+type ackFrame struct {
+	mac [6]byte
+	seq uint32
+}
+
+type inFlightEntry struct {
+	msg      persistentSend
+	lastSent time.Time
+	backoff  time.Duration
+}
+
+// SetMessageStore enables persistent delivery: every SendPersistent call is
+// written to store before going out over the wire, and un-ACKed messages
+// are replayed after the firmware resets or the serial link reconnects.
+func (b *Bridge) SetMessageStore(store MessageStore, cfg RetransmitConfig) {
+	b.store = store
+	b.retransmitCfg = cfg
+	go b.retransmitter()
+}
+
+// SendPersistent behaves like sending on Outbox, except the message is
+// durably stored first and retried until the firmware ACKs it.
+func (b *Bridge) SendPersistent(msg Message) error {
+	if b.store == nil {
+		return errors.New("no MessageStore configured, call SetMessageStore first")
+	}
+	seq, err := b.store.Save(msg)
+	if err != nil {
+		return err
+	}
+
+	b.inFlightMu.Lock()
+	if b.inFlight == nil {
+		b.inFlight = make(map[[6]byte]map[uint32]*inFlightEntry)
+	}
+	peerInFlight := b.inFlight[msg.Mac]
+	if peerInFlight == nil {
+		peerInFlight = make(map[uint32]*inFlightEntry)
+		b.inFlight[msg.Mac] = peerInFlight
+	}
+	maxInFlight := b.retransmitCfg.MaxInFlight
+	if maxInFlight == 0 {
+		maxInFlight = DefaultRetransmitConfig().MaxInFlight
+	}
+	if len(peerInFlight) >= maxInFlight {
+		b.inFlightMu.Unlock()
+		b.store.Ack(msg.Mac, seq)
+		return errNoInFlightWindow
+	}
+	ps := persistentSend{seq: seq, Message: msg}
+	peerInFlight[seq] = &inFlightEntry{msg: ps, lastSent: time.Now()}
+	b.inFlightMu.Unlock()
+
+	b.persistOutbox <- ps
+	return nil
+}
+
+func (b *Bridge) ackPersistent(mac [6]byte, seq uint32) {
+	b.inFlightMu.Lock()
+	if peerInFlight, ok := b.inFlight[mac]; ok {
+		delete(peerInFlight, seq)
+	}
+	b.inFlightMu.Unlock()
+	if b.store != nil {
+		b.store.Ack(mac, seq)
+	}
+}
+
+// retransmitter replays un-ACKed messages whenever the bridge (re)connects
+// and backs off retries for messages that are still in flight.
+func (b *Bridge) retransmitter() {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.connected:
+			b.replayPending()
+		case <-ticker.C:
+			b.retryOverdue()
+		}
+	}
+}
+
+func (b *Bridge) replayPending() {
+	if b.store == nil {
+		return
+	}
+	pending, err := b.store.Pending()
+	if err != nil {
+		return
+	}
+
+	b.inFlightMu.Lock()
+	if b.inFlight == nil {
+		b.inFlight = make(map[[6]byte]map[uint32]*inFlightEntry)
+	}
+	for _, p := range pending {
+		peerInFlight := b.inFlight[p.Mac]
+		if peerInFlight == nil {
+			peerInFlight = make(map[uint32]*inFlightEntry)
+			b.inFlight[p.Mac] = peerInFlight
+		}
+		peerInFlight[p.Seq] = &inFlightEntry{msg: persistentSend{seq: p.Seq, Message: p.Message}, lastSent: time.Now()}
+	}
+	b.inFlightMu.Unlock()
+
+	for _, p := range pending {
+		b.persistOutbox <- persistentSend{seq: p.Seq, Message: p.Message}
+	}
+}
+
+func (b *Bridge) retryOverdue() {
+	initial := b.retransmitCfg.InitialBackoff
+	max := b.retransmitCfg.MaxBackoff
+	if initial == 0 {
+		initial = DefaultRetransmitConfig().InitialBackoff
+	}
+	if max == 0 {
+		max = DefaultRetransmitConfig().MaxBackoff
+	}
+
+	now := time.Now()
+	var toResend []persistentSend
+
+	b.inFlightMu.Lock()
+	for _, peerInFlight := range b.inFlight {
+		for _, entry := range peerInFlight {
+			if entry.backoff == 0 {
+				entry.backoff = initial
+			}
+			if now.Sub(entry.lastSent) < entry.backoff {
+				continue
+			}
+			entry.lastSent = now
+			entry.backoff *= 2
+			if entry.backoff > max {
+				entry.backoff = max
+			}
+			toResend = append(toResend, entry.msg)
+		}
+	}
+	b.inFlightMu.Unlock()
+
+	for _, msg := range toResend {
+		b.persistOutbox <- msg
+	}
+}
+
+func parseAckFrame(mac, seqBytes []byte) ackFrame {
+	var af ackFrame
+	copy(af.mac[:], mac)
+	af.seq = binary.BigEndian.Uint32(seqBytes)
+	return af
+}
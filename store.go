@@ -0,0 +1,112 @@
+package bridge
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"sync"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// MessageStore persists outgoing messages until they are ACKed by the
+// bridge firmware, so a reset or flaky serial link does not silently
+// drop in-flight data.
+type MessageStore interface {
+	// Save assigns the message a monotonic sequence id and persists it.
+	Save(msg Message) (seq uint32, err error)
+	// Ack removes a previously saved message.
+	Ack(mac [6]byte, seq uint32) error
+	// Pending returns all un-ACKed messages for every peer, in the order
+	// they were saved, so they can be replayed after a reconnect.
+	Pending() ([]PersistedMessage, error)
+}
+
+// PersistedMessage is a Message together with the sequence id it was
+// saved under.
+type PersistedMessage struct {
+	Seq uint32
+	Message
+}
+
+var bucketName = []byte("outbox")
+
+// BoltMessageStore is the default MessageStore, backed by a bbolt file.
+type BoltMessageStore struct {
+	db *bolt.DB
+	mu sync.Mutex
+}
+
+// NewBoltMessageStore opens (creating if needed) a bbolt database at path
+// to use as the persistent outbox.
+func NewBoltMessageStore(path string) (*BoltMessageStore, error) {
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(bucketName)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltMessageStore{db: db}, nil
+}
+
+func (s *BoltMessageStore) Close() error {
+	return s.db.Close()
+}
+
+func seqKey(mac [6]byte, seq uint32) []byte {
+	key := make([]byte, 6+4)
+	copy(key[:6], mac[:])
+	binary.BigEndian.PutUint32(key[6:], seq)
+	return key
+}
+
+func (s *BoltMessageStore) Save(msg Message) (uint32, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var seq uint32
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(bucketName)
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		seq = uint32(id)
+		return b.Put(seqKey(msg.Mac, seq), msg.Data)
+	})
+	return seq, err
+}
+
+func (s *BoltMessageStore) Ack(mac [6]byte, seq uint32) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).Delete(seqKey(mac, seq))
+	})
+}
+
+func (s *BoltMessageStore) Pending() ([]PersistedMessage, error) {
+	var pending []PersistedMessage
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketName).ForEach(func(key, data []byte) error {
+			if len(key) != 10 {
+				return nil
+			}
+			var msg PersistedMessage
+			copy(msg.Mac[:], key[:6])
+			msg.Seq = binary.BigEndian.Uint32(key[6:])
+			msg.Data = append([]byte{}, data...)
+			pending = append(pending, msg)
+			return nil
+		})
+	})
+	// keys sort by mac first; seq comes from one bucket-wide sequence
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Seq < pending[j].Seq })
+	return pending, err
+}
+
+var errNoInFlightWindow = errors.New("peer has reached its maximum in-flight window")